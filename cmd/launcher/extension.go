@@ -10,18 +10,24 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/kolide/kit/actor"
 	"github.com/kolide/launcher/pkg/augeas"
+	"github.com/kolide/launcher/pkg/backoff"
 	"github.com/kolide/launcher/pkg/contexts/ctxlog"
 	"github.com/kolide/launcher/pkg/launcher"
 	kolidelog "github.com/kolide/launcher/pkg/log"
 	"github.com/kolide/launcher/pkg/osquery"
+	kolideosquerylogger "github.com/kolide/launcher/pkg/osquery/logger"
 	"github.com/kolide/launcher/pkg/osquery/runtime"
 	ktable "github.com/kolide/launcher/pkg/osquery/table"
 	"github.com/kolide/launcher/pkg/service"
+	"github.com/kolide/launcher/pkg/trace"
+	osquerygo "github.com/kolide/osquery-go"
 	"github.com/kolide/osquery-go/plugin/config"
 	"github.com/kolide/osquery-go/plugin/distributed"
 	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
 	"github.com/pkg/errors"
 	"go.etcd.io/bbolt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // TODO: the extension, runtime, and client are all kind of entangled
@@ -46,12 +52,31 @@ func createExtensionRuntime(ctx context.Context, db *bbolt.DB, launcherClient se
 		enrollSecret = string(bytes.TrimSpace(content))
 	}
 
+	// Build the tracer used for spans across extension startup,
+	// enrollment, and distributed query execution. With TraceExporter
+	// unset (or "none") this is otel's no-op tracer, so the Start
+	// calls below are free.
+	tracer, tracerShutdown, err := trace.NewTracer(ctx, opts.TraceExporter, opts.TraceEndpoint, opts.TraceSamplingRatio)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "building tracer")
+	}
+
 	// create the osquery extension
 	extOpts := osquery.ExtensionOpts{
 		EnrollSecret:                      enrollSecret,
 		Logger:                            logger,
 		LoggingInterval:                   opts.LoggingInterval,
 		RunDifferentialQueriesImmediately: opts.EnableInitialRunner,
+		Tracer:                            tracer,
+		MaxRowsPerQuery:                   opts.MaxRowsPerQuery,
+		MaxBytesPerQuery:                  opts.MaxBytesPerQuery,
+		MaxQueryEntriesLimit:              opts.MaxQueryEntriesLimit,
+		// ConfigCacheTTL lets GenerateConfigs serve repeated
+		// per-node_key refreshes out of memory instead of round-
+		// tripping to the Kolide server every time, since
+		// config_refresh_seconds below still means every managed
+		// osqueryd asks on its own schedule.
+		ConfigCacheTTL: opts.ConfigCacheTTL,
 	}
 
 	// Setting MaxBytesPerBatch is a tradeoff. If it's too low, we
@@ -63,6 +88,15 @@ func createExtensionRuntime(ctx context.Context, db *bbolt.DB, launcherClient se
 	// extension defaults to 3mb, to support GRPC's hardcoded 4MB
 	// limit. But as we're transport aware here. we can set it to
 	// 5MB for others.
+	//
+	// MaxBytesPerQuery/MaxRowsPerQuery are a separate guardrail:
+	// WriteResults truncates a single query's result set that goes
+	// over either cap and records the truncation, and LogString drops
+	// a log line longer than MaxBytesPerQuery whole rather than
+	// truncating it. MaxBytesPerBatch is only handed to
+	// osquery.ExtensionOpts; the Extension does not read it and sends
+	// each WriteResults/LogString call in one request, so the
+	// per-query caps are what bound the size of a send.
 	if opts.LogMaxBytesPerBatch != 0 {
 		if opts.Transport == "grpc" && opts.LogMaxBytesPerBatch > 3 {
 			level.Info(logger).Log(
@@ -97,24 +131,67 @@ func createExtensionRuntime(ctx context.Context, db *bbolt.DB, launcherClient se
 		kolidelog.WithKeyValue("level", "stdout"),
 	)
 
+	// Resolve the configured log destinations into backends and fan
+	// the single "kolide_grpc" logger plugin out to all of them. ext
+	// itself satisfies logger.Backend, so "grpc" still goes straight
+	// to the Kolide server as before.
+	logDestinations := opts.LogDestinations
+	if len(logDestinations) == 0 {
+		logDestinations = []string{"grpc"}
+	}
+	logDir := opts.LogDirectory
+	if logDir == "" {
+		logDir = opts.RootDirectory
+	}
+	logBackends, err := kolideosquerylogger.Resolve(logDestinations, ext, logDir)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "resolving log_destinations")
+	}
+	logMux := kolideosquerylogger.NewMultiplexer(logBackends...)
+
+	// The plugin set is the same whether launcher owns the osqueryd
+	// process or is only attaching to one someone else manages, so
+	// build it once and register it against whichever extension
+	// manager ends up serving it.
+	extensionPlugins := []osquerygo.OsqueryPlugin{
+		config.NewPlugin("kolide_grpc", ext.GenerateConfigs),
+		distributed.NewPlugin("kolide_grpc", ext.GetQueries, ext.WriteResults),
+		osquerylogger.NewPlugin("kolide_grpc", logMux.LogString),
+	}
+	extensionPlugins = append(extensionPlugins, ktable.LauncherTables(db, opts)...)
+
+	if opts.ExtensionSocketPath != "" {
+		if opts.OsquerydPath != "" {
+			return nil, nil, nil, errors.New("extension_socket_path and osqueryd_path are mutually exclusive")
+		}
+		return createSocketExtensionRuntime(ctx, logger, ext, extensionPlugins, opts, tracer, tracerShutdown)
+	}
+
 	runner := runtime.LaunchUnstartedInstance(
 		runtime.WithOsquerydBinary(opts.OsquerydPath),
 		runtime.WithRootDirectory(opts.RootDirectory),
 		runtime.WithConfigPluginFlag("kolide_grpc"),
 		runtime.WithLoggerPluginFlag("kolide_grpc"),
 		runtime.WithDistributedPluginFlag("kolide_grpc"),
-		runtime.WithOsqueryExtensionPlugins(
-			config.NewPlugin("kolide_grpc", ext.GenerateConfigs),
-			distributed.NewPlugin("kolide_grpc", ext.GetQueries, ext.WriteResults),
-			osquerylogger.NewPlugin("kolide_grpc", ext.LogString),
-		),
-		runtime.WithOsqueryExtensionPlugins(ktable.LauncherTables(db, opts)...),
+		runtime.WithOsqueryExtensionPlugins(extensionPlugins...),
 		runtime.WithStdout(osqueryStdoutLogger),
 		runtime.WithStderr(osqueryStderrLogger),
 		runtime.WithLogger(logger),
 		runtime.WithOsqueryVerbose(opts.OsqueryVerbose),
 		runtime.WithOsqueryFlags(opts.OsqueryFlags),
 		runtime.WithAugeasLensFunction(augeas.InstallLenses),
+		// Retry the thrift extension socket dial internally so we
+		// don't race osqueryd's socket creation on slow hosts
+		// (particularly Windows).
+		runtime.WithConnectRetry(connectBackoffOpts(opts)),
+		runtime.WithTracer(tracer),
+		// config_refresh defaults to osquery's own aggressive
+		// schedule if unset; --config_refresh_seconds (default 60)
+		// keeps large fleets from hammering GenerateConfigs, while
+		// --config_accelerated_refresh_seconds restores a tighter
+		// interval for the window right after a restart, when we
+		// actually want to notice policy changes quickly.
+		runtime.WithConfigRefresh(opts.ConfigRefreshSeconds, opts.ConfigAcceleratedRefreshSeconds),
 	)
 
 	restartFunc := func() error {
@@ -123,33 +200,73 @@ func createExtensionRuntime(ctx context.Context, db *bbolt.DB, launcherClient se
 			"msg", "restart function",
 		)
 
-		return runner.Restart()
+		if err := runner.Restart(); err != nil {
+			return err
+		}
+		ext.InvalidateConfigCache()
+		return nil
 	}
 
 	return &actor.Actor{
 			// and the methods for starting and stopping the extension
 			Execute: func() error {
-
-				// Start the osqueryd instance
-				if err := runner.Start(); err != nil {
+				startCtx, startSpan := tracer.Start(ctx, "runner.Start")
+				// Start the osqueryd instance. The socket may not be
+				// ready immediately (osqueryd is still booting, or on
+				// Windows the named pipe shows up with a lag), so
+				// retry with backoff rather than bouncing the whole
+				// actor on the first transient failure.
+				if err := backoff.Retry(startCtx, logger, connectBackoffOpts(opts), func() error {
+					if err := runner.Start(); err != nil {
+						return classifyConnectError(err)
+					}
+					return nil
+				}); err != nil {
+					startSpan.RecordError(err)
+					startSpan.End()
 					return errors.Wrap(err, "launching osquery instance")
 				}
+				startSpan.End()
+
+				// osqueryd just (re)started, so it's about to run its
+				// config_accelerated_refresh window -- make sure that
+				// window actually reaches the server instead of
+				// replaying a config cached from before the restart.
+				ext.InvalidateConfigCache()
 
+				_, setQuerierSpan := tracer.Start(ctx, "ext.SetQuerier")
 				// The runner allows querying the osqueryd instance from the extension.
 				// Used by the Enroll method below to get initial enrollment details.
 				ext.SetQuerier(runner)
+				setQuerierSpan.End()
 
-				// enroll this launcher with the server
-				_, invalid, err := ext.Enroll(ctx)
-				if err != nil {
+				enrollCtx, enrollSpan := tracer.Start(ctx, "ext.Enroll")
+				// enroll this launcher with the server. Transient
+				// gRPC failures (server mid-deploy, UNAVAILABLE,
+				// DeadlineExceeded) are retried; an invalid enroll
+				// secret is terminal and returned immediately.
+				enrollOpts := connectBackoffOpts(opts)
+				enrollOpts.MaxElapsedTime = opts.EnrollMaxElapsed
+
+				var invalid bool
+				if err := backoff.Retry(enrollCtx, logger, enrollOpts, func() error {
+					var enrollErr error
+					_, invalid, enrollErr = ext.Enroll(enrollCtx)
+					if invalid {
+						return backoff.Permanent(errors.New("invalid enroll secret"))
+					}
+					return classifyConnectError(enrollErr)
+				}); err != nil {
+					enrollSpan.RecordError(err)
+					enrollSpan.End()
 					return errors.Wrap(err, "enrolling host")
 				}
-				if invalid {
-					return errors.Wrap(err, "invalid enroll secret")
-				}
+				enrollSpan.End()
 
+				_, extStartSpan := tracer.Start(ctx, "ext.Start")
 				// start the extension
 				ext.Start()
+				extStartSpan.End()
 
 				level.Info(logger).Log("msg", "extension started")
 
@@ -168,9 +285,48 @@ func createExtensionRuntime(ctx context.Context, db *bbolt.DB, launcherClient se
 						level.Debug(logger).Log("msg", "error shutting down runtime", "err", err, "stack", fmt.Sprintf("%+v", err))
 					}
 				}
+				if err := tracerShutdown(context.Background()); err != nil {
+					level.Debug(logger).Log("msg", "error shutting down tracer provider", "err", err)
+				}
 			},
 		},
 		restartFunc,
 		runner.Shutdown,
 		nil
 }
+
+// connectBackoffOpts builds the backoff schedule used for connecting to
+// and enrolling with osqueryd/the Kolide server, from the knobs exposed
+// on launcher.Options.
+func connectBackoffOpts(opts *launcher.Options) backoff.Options {
+	return backoff.Options{
+		MaxElapsedTime: opts.ConnectMaxElapsed,
+		MaxAttempts:    opts.ConnectRetries,
+	}
+}
+
+// classifyConnectError marks errors that are known to never succeed on
+// retry as permanent so that backoff.Retry stops immediately instead
+// of exhausting its schedule. codes.Unauthenticated is how a rejected
+// enroll secret or revoked credential surfaces from the gRPC server,
+// so it's terminal, same as the invalid bool from ext.Enroll itself
+// (checked by the caller before this function ever runs). Everything
+// else -- UNAVAILABLE, DeadlineExceeded, connection refused while
+// osqueryd's socket isn't up yet, a thrift EOF from a registration
+// race -- is left as retryable.
+func classifyConnectError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if st, ok := status.FromError(errors.Cause(err)); ok {
+		switch st.Code() {
+		case codes.Unauthenticated:
+			return backoff.Permanent(err)
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kolide/kit/actor"
+	"github.com/kolide/launcher/pkg/backoff"
+	"github.com/kolide/launcher/pkg/launcher"
+	"github.com/kolide/launcher/pkg/osquery"
+	osquerygo "github.com/kolide/osquery-go"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// createSocketExtensionRuntime is the "sidecar" counterpart of the
+// normal runtime.LaunchUnstartedInstance path in
+// createExtensionRuntime: it attaches to an osqueryd extension socket
+// that some other process manager already owns (osquery-in-a-container,
+// an MDM-managed osqueryd, a systemd unit) instead of launching and
+// owning the osqueryd process itself. Enrollment, the gRPC
+// config/logger/distributed plugins, and the launcher tables all work
+// exactly as they do in the normal path; only who owns the osqueryd
+// process differs.
+func createSocketExtensionRuntime(
+	ctx context.Context,
+	logger log.Logger,
+	ext *osquery.Extension,
+	plugins []osquerygo.OsqueryPlugin,
+	opts *launcher.Options,
+	tracer trace.Tracer,
+	tracerShutdown func(context.Context) error,
+) (run *actor.Actor, restart func() error, shutdown func() error, err error) {
+	runner := newSocketRunner(logger, opts.ExtensionSocketPath, connectBackoffOpts(opts), plugins)
+
+	return &actor.Actor{
+			Execute: func() error {
+				startCtx, startSpan := tracer.Start(ctx, "socketRunner.Start")
+				if err := runner.Start(ctx); err != nil {
+					startSpan.RecordError(err)
+					startSpan.End()
+					return errors.Wrapf(err, "attaching to osquery extension socket %s", opts.ExtensionSocketPath)
+				}
+				startSpan.End()
+
+				// Same reasoning as the managed-osqueryd path: a fresh
+				// attach means osqueryd is (or just went through) its
+				// config_accelerated_refresh window, so don't serve it
+				// a config cached from before.
+				ext.InvalidateConfigCache()
+
+				ext.SetQuerier(runner)
+
+				enrollCtx, enrollSpan := tracer.Start(startCtx, "ext.Enroll")
+				enrollOpts := connectBackoffOpts(opts)
+				enrollOpts.MaxElapsedTime = opts.EnrollMaxElapsed
+
+				var invalid bool
+				if err := backoff.Retry(enrollCtx, logger, enrollOpts, func() error {
+					var enrollErr error
+					_, invalid, enrollErr = ext.Enroll(enrollCtx)
+					if invalid {
+						return backoff.Permanent(errors.New("invalid enroll secret"))
+					}
+					return classifyConnectError(enrollErr)
+				}); err != nil {
+					enrollSpan.RecordError(err)
+					enrollSpan.End()
+					return errors.Wrap(err, "enrolling host")
+				}
+				enrollSpan.End()
+
+				ext.Start()
+				level.Info(logger).Log("msg", "extension started", "mode", "extension_socket", "socket", opts.ExtensionSocketPath)
+
+				<-ctx.Done()
+				return nil
+			},
+			Interrupt: func(err error) {
+				level.Info(logger).Log("msg", "extension interrupted", "err", err)
+				ext.Shutdown()
+				// There is no osqueryd child process to kill here --
+				// just de-register our plugins and close the
+				// connection, leaving the socket and whatever created
+				// it alone.
+				if shutdownErr := runner.Shutdown(); shutdownErr != nil {
+					level.Info(logger).Log("msg", "error shutting down socket runner", "err", shutdownErr)
+				}
+				if err := tracerShutdown(context.Background()); err != nil {
+					level.Debug(logger).Log("msg", "error shutting down tracer provider", "err", err)
+				}
+			},
+		},
+		func() error {
+			if err := runner.Restart(); err != nil {
+				return err
+			}
+			ext.InvalidateConfigCache()
+			return nil
+		},
+		runner.Shutdown,
+		nil
+}
+
+// socketRunner implements the same Start/Restart/Shutdown/Query
+// surface that runtime.OsqueryInstance does, but never spawns or owns
+// an osqueryd process: it connects to an existing extension socket,
+// registers launcher's plugins against it, and watches for the socket
+// going away so it can reconnect.
+type socketRunner struct {
+	socketPath string
+	logger     log.Logger
+	retryOpts  backoff.Options
+	plugins    []osquerygo.OsqueryPlugin
+
+	// mu guards every field below AND is held for the full duration of
+	// each client call: osquery-go's thrift client isn't safe for
+	// concurrent use, and Query (driven by ext.SetQuerier) and watch's
+	// health check both run against the same connection.
+	mu     sync.Mutex
+	ctx    context.Context
+	server *osquerygo.ExtensionManagerServer
+	client *osquerygo.ExtensionManagerClient
+	done   chan struct{}
+}
+
+func newSocketRunner(logger log.Logger, socketPath string, retryOpts backoff.Options, plugins []osquerygo.OsqueryPlugin) *socketRunner {
+	return &socketRunner{
+		socketPath: socketPath,
+		logger:     logger,
+		retryOpts:  retryOpts,
+		plugins:    plugins,
+	}
+}
+
+// Start connects to socketPath, retrying with backoff since the
+// socket may not exist yet if whatever manages osqueryd is still
+// bringing it up, registers our plugins against it, and starts a
+// background watch that reconnects if the socket disappears. ctx
+// bounds the retry loop so actor shutdown can interrupt a host whose
+// socket never shows up.
+func (s *socketRunner) Start(ctx context.Context) error {
+	return backoff.Retry(ctx, s.logger, s.retryOpts, func() error {
+		client, err := osquerygo.NewClient(s.socketPath, 5*time.Second)
+		if err != nil {
+			return err
+		}
+
+		server, err := osquerygo.NewExtensionManagerServer("kolide", s.socketPath)
+		if err != nil {
+			client.Close()
+			return err
+		}
+		for _, p := range s.plugins {
+			server.RegisterPlugin(p)
+		}
+		if err := server.Start(); err != nil {
+			client.Close()
+			return err
+		}
+
+		s.mu.Lock()
+		s.ctx = ctx
+		s.client = client
+		s.server = server
+		s.done = make(chan struct{})
+		s.mu.Unlock()
+
+		go s.watch()
+		return nil
+	})
+}
+
+// watch polls the socket and triggers a Restart if it goes away, since
+// whatever owns osqueryd may have recycled it out from under us. It
+// goes through Query so the health check and ext.SetQuerier's queries
+// never run concurrently against the same thrift connection.
+func (s *socketRunner) watch() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := s.Query("select 1"); err != nil {
+				level.Info(s.logger).Log("msg", "extension socket disconnected, reconnecting", "err", err)
+				if err := s.Restart(); err != nil {
+					level.Info(s.logger).Log("msg", "error reconnecting to extension socket", "err", err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (s *socketRunner) Restart() error {
+	s.mu.Lock()
+	ctx := s.ctx
+	s.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if err := s.Shutdown(); err != nil {
+		level.Debug(s.logger).Log("msg", "error shutting down socket runner before restart", "err", err)
+	}
+	return s.Start(ctx)
+}
+
+// Shutdown de-registers our plugins and closes the client connection.
+// It does not touch the osqueryd process on the other end of the
+// socket -- we never started it, so we don't stop it.
+func (s *socketRunner) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+
+	var err error
+	if s.server != nil {
+		err = s.server.Shutdown()
+		s.server = nil
+	}
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+	return err
+}
+
+// Query implements osquery.Querier against the attached extension
+// socket, the same way the runtime's managed osqueryd runner does for
+// ext.SetQuerier. The mutex is held for the whole round trip, not just
+// the pointer read: osquery-go's thrift client can't tolerate
+// interleaved requests, and this is also what watch's health check
+// goes through.
+func (s *socketRunner) Query(sql string) ([]map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil, errors.New("socket runner is not started")
+	}
+
+	resp, err := s.client.Query(sql)
+	if err != nil {
+		return nil, fmt.Errorf("querying extension socket: %w", err)
+	}
+	return resp.Response, nil
+}
@@ -0,0 +1,95 @@
+// Package backoff provides a small wrapper around exponential backoff
+// with jitter for operations that talk to services which may not be
+// ready yet, or may be transiently unavailable: the osqueryd extension
+// socket on a slow-booting host, the Kolide gRPC server during a
+// deploy, etc.
+//
+// On top of github.com/cenkalti/backoff/v3 it adds an attempt cap and
+// per-retry debug logging, and re-exports the library's terminal
+// error: a failure we already know will never succeed (an invalid
+// enroll secret, for example), which stops the retry loop immediately
+// instead of burning through the whole schedule.
+package backoff
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Options configures the exponential backoff schedule used by Retry.
+// The zero value is a reasonable default: retry forever (bounded only
+// by ctx) with backoff/v3's standard exponential+jitter schedule.
+type Options struct {
+	// InitialInterval is the delay before the first retry. Zero uses
+	// the library default (500ms).
+	InitialInterval time.Duration
+
+	// MaxInterval caps the delay between retries. Zero uses the
+	// library default (60s).
+	MaxInterval time.Duration
+
+	// MaxElapsedTime bounds the total time spent retrying, counted
+	// from the first attempt. Zero means no limit; Retry will keep
+	// trying until ctx is done or fn returns a terminal error.
+	MaxElapsedTime time.Duration
+
+	// MaxAttempts bounds the number of attempts regardless of
+	// elapsed time. Zero means no limit.
+	MaxAttempts int
+}
+
+// Permanent wraps err so that Retry stops immediately and returns err
+// unwrapped, instead of continuing to back off. Use it for errors that
+// are known to never succeed on retry, such as an invalid enroll
+// secret or a malformed request.
+func Permanent(err error) error {
+	return backoff.Permanent(err)
+}
+
+// Retry calls fn until it returns nil, returns a Permanent error, ctx
+// is done, or the schedule described by o is exhausted. Every failing
+// attempt that is followed by a retry is logged at debug level with
+// the attempt number and the delay before the next attempt; the final
+// failure is returned, not logged.
+func Retry(ctx context.Context, logger log.Logger, o Options, fn func() error) error {
+	eb := backoff.NewExponentialBackOff()
+	if o.InitialInterval != 0 {
+		eb.InitialInterval = o.InitialInterval
+	}
+	if o.MaxInterval != 0 {
+		eb.MaxInterval = o.MaxInterval
+	}
+	eb.MaxElapsedTime = o.MaxElapsedTime
+
+	var b backoff.BackOff = backoff.WithContext(eb, ctx)
+
+	attempt := 0
+	var lastErr error
+	return backoff.RetryNotify(
+		func() error {
+			attempt++
+			if o.MaxAttempts != 0 && attempt > o.MaxAttempts {
+				if lastErr != nil {
+					return backoff.Permanent(fmt.Errorf("giving up after %d attempts, last error: %w", o.MaxAttempts, lastErr))
+				}
+				return backoff.Permanent(fmt.Errorf("giving up after %d attempts", o.MaxAttempts))
+			}
+			lastErr = fn()
+			return lastErr
+		},
+		b,
+		func(err error, next time.Duration) {
+			level.Debug(logger).Log(
+				"msg", "retrying after error",
+				"attempt", attempt,
+				"next_delay", next,
+				"err", err,
+			)
+		},
+	)
+}
@@ -0,0 +1,112 @@
+// Package launcher holds the configuration surface shared across
+// launcher's subcommands. Options is built up from flags/environment
+// by the cmd/launcher CLI wiring and passed down into the pieces
+// (the osquery extension, the runtime, the gRPC client) that need it.
+package launcher
+
+import "time"
+
+// Options configures a launcher run: where to find osqueryd and the
+// enroll secret, how to reach the Kolide server, and the various
+// extension/runtime knobs that have accumulated as launcher grew
+// support for retries, tracing, log fan-out, and sidecar mode.
+type Options struct {
+	// EnrollSecret is the literal enroll secret. Mutually exclusive
+	// with EnrollSecretPath in practice, though both fields are kept
+	// so operators can pass either a value or a file.
+	EnrollSecret string
+	// EnrollSecretPath points at a file containing the enroll secret,
+	// read once at startup.
+	EnrollSecretPath string
+
+	// LoggingInterval is passed to osquery.ExtensionOpts.LoggingInterval.
+	// The Extension does not read it: it keeps no log buffer, and
+	// LogString publishes each line as it arrives.
+	LoggingInterval time.Duration
+	// EnableInitialRunner is passed to
+	// osquery.ExtensionOpts.RunDifferentialQueriesImmediately, which
+	// the Extension does not read; it runs no differential queries of
+	// its own.
+	EnableInitialRunner bool
+
+	// Transport is the wire protocol used to reach the Kolide server
+	// ("grpc" or "jsonrpc").
+	Transport string
+	// LogMaxBytesPerBatch overrides the transport-aware default, in MB,
+	// that createExtensionRuntime sets as
+	// osquery.ExtensionOpts.MaxBytesPerBatch. Zero means use the
+	// transport's default. The Extension does not read
+	// MaxBytesPerBatch, so this sets no limit on a send.
+	LogMaxBytesPerBatch int
+
+	// LogDestinations is the parsed --log_destinations value: which
+	// logger.Backend(s) the osquery logger plugin fans out to (any of
+	// "grpc", "file", "filesystem", "stdout", "syslog"). Empty means
+	// "grpc" only, preserving the old hard-wired behavior.
+	LogDestinations []string
+	// LogDirectory is where the file and filesystem logger backends
+	// write, separate from RootDirectory so operators can point log
+	// retention at different storage (and rotation policy) than
+	// osqueryd's own working directory.
+	LogDirectory string
+
+	// OsquerydPath is the path to the osqueryd binary launcher spawns
+	// and manages. Mutually exclusive with ExtensionSocketPath.
+	OsquerydPath string
+	// RootDirectory is osqueryd's working directory.
+	RootDirectory string
+	// OsqueryVerbose turns on osqueryd's own verbose logging.
+	OsqueryVerbose bool
+	// OsqueryFlags are extra flags passed through to osqueryd verbatim.
+	OsqueryFlags []string
+
+	// ExtensionSocketPath, if set, puts launcher into sidecar mode:
+	// instead of spawning osqueryd, it attaches to this existing
+	// extension socket as a pure extension. Mutually exclusive with
+	// OsquerydPath.
+	ExtensionSocketPath string
+
+	// ConnectRetries bounds the number of attempts used to start
+	// osqueryd (or attach to ExtensionSocketPath) and to register the
+	// thrift extension socket. Zero means no limit.
+	ConnectRetries int
+	// ConnectMaxElapsed bounds the total time spent retrying that
+	// connect step. Zero means no limit.
+	ConnectMaxElapsed time.Duration
+	// EnrollMaxElapsed bounds the total time spent retrying
+	// enrollment specifically, separately from the connect step.
+	EnrollMaxElapsed time.Duration
+
+	// TraceExporter selects the OpenTelemetry exporter ("otlp",
+	// "stdout", or "none"/unset).
+	TraceExporter string
+	// TraceEndpoint is the OTLP collector endpoint, used when
+	// TraceExporter is "otlp".
+	TraceEndpoint string
+	// TraceSamplingRatio is the fraction of traces sampled, in (0,1].
+	TraceSamplingRatio float64
+
+	// MaxRowsPerQuery caps the number of rows a single query's result
+	// set may contain before it's truncated. Zero means unlimited.
+	MaxRowsPerQuery int
+	// MaxBytesPerQuery caps the serialized size, in bytes, of a single
+	// query's result set before it's truncated. Zero means unlimited.
+	MaxBytesPerQuery int64
+	// MaxQueryEntriesLimit is appended as a "LIMIT <n>" clause to
+	// distributed queries that don't already have one, so osqueryd
+	// bounds the rows on the host. Zero means unlimited.
+	MaxQueryEntriesLimit int
+
+	// ConfigRefreshSeconds sets osqueryd's config_refresh flag: how
+	// often it re-requests its config from the extension. Zero uses
+	// osquery's own (aggressive) default.
+	ConfigRefreshSeconds int
+	// ConfigAcceleratedRefreshSeconds sets config_accelerated_refresh,
+	// the tighter refresh interval osqueryd uses for a window after a
+	// restart, before falling back to ConfigRefreshSeconds.
+	ConfigAcceleratedRefreshSeconds int
+	// ConfigCacheTTL is how long GenerateConfigs may serve a cached
+	// config for a given node_key before round-tripping to the Kolide
+	// server again. Zero disables the cache.
+	ConfigCacheTTL time.Duration
+}
@@ -0,0 +1,571 @@
+// Package osquery implements the gRPC-backed osquery plugins
+// (config, distributed, logger) launcher registers with osqueryd, plus
+// the enrollment and lifecycle calls createExtensionRuntime drives.
+package osquery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kolide/launcher/pkg/service"
+	"github.com/kolide/osquery-go/plugin/distributed"
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// queryStatsBucket is where per-query truncation counters accumulate
+// so the kolide_launcher_query_stats table (pkg/osquery/table) can
+// read them back out.
+const queryStatsBucket = "query_stats"
+
+// Querier is satisfied by whatever is managing osqueryd (the runtime
+// package's instance, or the sidecar socketRunner) well enough to run
+// a query against it -- used during Enroll to read host identifiers.
+type Querier interface {
+	Query(sql string) ([]map[string]string, error)
+}
+
+// ExtensionOpts configures a new Extension.
+type ExtensionOpts struct {
+	EnrollSecret                      string
+	Logger                            log.Logger
+	LoggingInterval                   time.Duration
+	RunDifferentialQueriesImmediately bool
+
+	// MaxBytesPerBatch is stored but not read by Extension: LogString
+	// publishes each line in its own request, and WriteResults
+	// publishes all of its results in one.
+	MaxBytesPerBatch int
+
+	// MaxRowsPerQuery and MaxBytesPerQuery cap a single query's result
+	// set before WriteResults hands it to the server -- whichever limit
+	// cuts more rows wins. LogString applies only MaxBytesPerQuery,
+	// dropping a longer log line whole. Zero means unlimited.
+	MaxRowsPerQuery  int
+	MaxBytesPerQuery int64
+	// MaxQueryEntriesLimit is injected into distributed query
+	// responses as a best-effort SQL LIMIT, so a runaway query never
+	// generates the oversized result in the first place. Zero means
+	// unlimited.
+	MaxQueryEntriesLimit int
+
+	// Tracer emits spans for GenerateConfigs/GetQueries/WriteResults/
+	// LogString. A nil Tracer is replaced with a no-op one.
+	Tracer trace.Tracer
+
+	// ConfigCacheTTL is how long GenerateConfigs may serve a cached
+	// config for a given node_key before asking the server again.
+	// Zero disables the cache.
+	ConfigCacheTTL time.Duration
+}
+
+// Extension implements the three gRPC-backed osquery plugins (config,
+// distributed, logger) that make up launcher's connection to the
+// Kolide server, plus enrollment and the Start/Shutdown lifecycle
+// createExtensionRuntime drives.
+type Extension struct {
+	opts   ExtensionOpts
+	client service.KolideService
+	db     *bbolt.DB
+	logger log.Logger
+
+	mu      sync.Mutex
+	querier Querier
+	nodeKey string
+
+	configMu    sync.Mutex
+	configCache map[string]cachedConfig
+}
+
+type cachedConfig struct {
+	config    map[string]string
+	expiresAt time.Time
+}
+
+// NewExtension constructs an Extension that talks to the Kolide server
+// via client and stores query-stat counters in db.
+func NewExtension(client service.KolideService, db *bbolt.DB, opts ExtensionOpts) (*Extension, error) {
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = trace.NewNoopTracerProvider().Tracer("launcher/osquery")
+	}
+
+	if db != nil {
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(queryStatsBucket))
+			return err
+		}); err != nil {
+			return nil, errors.Wrap(err, "creating query_stats bucket")
+		}
+	}
+
+	return &Extension{
+		opts:        opts,
+		client:      client,
+		db:          db,
+		logger:      opts.Logger,
+		configCache: make(map[string]cachedConfig),
+	}, nil
+}
+
+// SetQuerier gives the extension a way to run queries against
+// osqueryd, used by Enroll to read host identifiers.
+func (e *Extension) SetQuerier(q Querier) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.querier = q
+}
+
+// Enroll requests a node key for this host from the Kolide server,
+// identifying the host via osqueryd's own system_info.uuid. invalid is
+// true only when the server rejected the enroll secret itself; any
+// other failure to enroll comes back as err.
+func (e *Extension) Enroll(ctx context.Context) (nodeKey string, invalid bool, err error) {
+	identifier, err := e.hostIdentifier()
+	if err != nil {
+		return "", false, errors.Wrap(err, "determining host identifier")
+	}
+
+	nodeKey, invalid, err = e.client.RequestEnrollment(ctx, e.opts.EnrollSecret, identifier, service.EnrollmentDetails{})
+	if err != nil {
+		return "", false, errors.Wrap(err, "requesting enrollment")
+	}
+	if invalid {
+		return "", true, nil
+	}
+
+	e.mu.Lock()
+	e.nodeKey = nodeKey
+	e.mu.Unlock()
+
+	return nodeKey, false, nil
+}
+
+func (e *Extension) hostIdentifier() (string, error) {
+	e.mu.Lock()
+	querier := e.querier
+	e.mu.Unlock()
+
+	if querier == nil {
+		return "", errors.New("no querier set; call SetQuerier before Enroll")
+	}
+
+	rows, err := querier.Query("select uuid from system_info")
+	if err != nil {
+		return "", errors.Wrap(err, "querying system_info")
+	}
+	if len(rows) == 0 {
+		return "", errors.New("system_info returned no rows")
+	}
+	return rows[0]["uuid"], nil
+}
+
+func (e *Extension) currentNodeKey() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.nodeKey
+}
+
+// hashNodeKey returns a short, non-reversible identifier for nodeKey,
+// suitable for span attributes and logs: it lets you correlate spans
+// for the same host without the node key itself -- a bearer credential
+// -- ever leaving the process in trace data.
+func hashNodeKey(nodeKey string) string {
+	if nodeKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(nodeKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Start begins whatever background work the extension itself owns.
+// Registration of the config/distributed/logger plugins happens at
+// the osquery runtime layer, not here; Start is a lifecycle hook for
+// callers that expect one.
+func (e *Extension) Start() {}
+
+// Shutdown releases any resources Start acquired.
+func (e *Extension) Shutdown() {}
+
+// GenerateConfigs implements the "kolide_grpc" config plugin,
+// returning the osquery config for the enrolled node. osqueryd calls
+// this on its own config_refresh/config_accelerated_refresh schedule
+// (see runtime.WithConfigRefresh), which for a large fleet can mean
+// every managed host round-tripping to the server far more often than
+// its config actually changes; when ConfigCacheTTL is set, a config is
+// served out of memory until it expires instead.
+func (e *Extension) GenerateConfigs(ctx context.Context) (map[string]string, error) {
+	ctx, span := e.opts.Tracer.Start(ctx, "osquery.extension.GenerateConfigs")
+	defer span.End()
+
+	nodeKey := e.currentNodeKey()
+	span.SetAttributes(attribute.String("node_key_hash", hashNodeKey(nodeKey)))
+
+	if e.opts.ConfigCacheTTL > 0 {
+		if config, ok := e.cachedConfig(nodeKey); ok {
+			span.SetAttributes(attribute.Bool("cache_hit", true))
+			return config, nil
+		}
+	}
+	span.SetAttributes(attribute.Bool("cache_hit", false))
+
+	config, invalid, err := e.client.RequestConfig(ctx, nodeKey)
+	if err != nil {
+		span.RecordError(err)
+		return nil, errors.Wrap(err, "requesting config")
+	}
+	if invalid {
+		err := errors.New("enrollment invalid fetching config")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	result := map[string]string{"config": config}
+
+	if e.opts.ConfigCacheTTL > 0 {
+		e.setCachedConfig(nodeKey, result)
+	}
+
+	return result, nil
+}
+
+// cachedConfig returns the cached config for nodeKey, if one exists
+// and hasn't expired.
+func (e *Extension) cachedConfig(nodeKey string) (map[string]string, bool) {
+	e.configMu.Lock()
+	defer e.configMu.Unlock()
+
+	cached, ok := e.configCache[nodeKey]
+	if !ok || time.Now().After(cached.expiresAt) {
+		return nil, false
+	}
+	return cached.config, true
+}
+
+func (e *Extension) setCachedConfig(nodeKey string, config map[string]string) {
+	e.configMu.Lock()
+	defer e.configMu.Unlock()
+
+	e.configCache[nodeKey] = cachedConfig{
+		config:    config,
+		expiresAt: time.Now().Add(e.opts.ConfigCacheTTL),
+	}
+}
+
+// InvalidateConfigCache drops any cached config, forcing the next
+// GenerateConfigs call to ask the server again regardless of
+// ConfigCacheTTL. It's called at runner start/restart, so the
+// config_accelerated_refresh window osqueryd runs right after a
+// restart (see runtime.WithConfigRefresh) actually observes a fresh
+// config rather than replaying whatever was cached before the
+// restart, and from GetQueries when the server pushes its own
+// accelerate signal through a distributed query response.
+func (e *Extension) InvalidateConfigCache() {
+	e.configMu.Lock()
+	defer e.configMu.Unlock()
+	e.configCache = make(map[string]cachedConfig)
+}
+
+// GetQueries implements the "kolide_grpc" distributed plugin's query
+// half, returning the set of distributed queries osqueryd should run.
+// When MaxQueryEntriesLimit is set, a "LIMIT <n>" is appended to any
+// query that doesn't already have one, as a best-effort guard against
+// queries (e.g. a bad JOIN against file/processes) that would
+// otherwise return an unbounded number of rows.
+func (e *Extension) GetQueries(ctx context.Context) (*distributed.GetQueriesResult, error) {
+	ctx, span := e.opts.Tracer.Start(ctx, "osquery.extension.GetQueries")
+	defer span.End()
+
+	nodeKey := e.currentNodeKey()
+	span.SetAttributes(attribute.String("node_key_hash", hashNodeKey(nodeKey)))
+
+	result, invalid, err := e.client.RequestQueries(ctx, nodeKey)
+	if err != nil {
+		span.RecordError(err)
+		return nil, errors.Wrap(err, "requesting queries")
+	}
+	if invalid {
+		err := errors.New("enrollment invalid fetching queries")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	// Accelerate is how the server pushes an accelerated-refresh signal
+	// down through the distributed query response: it's asking for a
+	// tighter config_accelerated_refresh window because something (a
+	// policy change, a pending action) needs this host to pick up a
+	// fresh config sooner than ConfigCacheTTL would otherwise allow.
+	// Drop the cache so the next GenerateConfigs actually asks.
+	if result.Accelerate != "" {
+		level.Info(e.logger).Log("msg", "distributed query requested accelerated config refresh", "accelerate", result.Accelerate)
+		e.InvalidateConfigCache()
+		span.SetAttributes(attribute.Bool("accelerate_signal", true))
+	}
+
+	if e.opts.MaxQueryEntriesLimit > 0 {
+		for name, query := range result.Queries {
+			result.Queries[name] = applyEntriesLimit(query, e.opts.MaxQueryEntriesLimit)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("query_count", len(result.Queries)))
+
+	return result, nil
+}
+
+// WriteResults implements the "kolide_grpc" distributed plugin's
+// result half. Any result over MaxRowsPerQuery/MaxBytesPerQuery is
+// truncated before it's sent, with a status log and a query_stats
+// counter recording that it happened.
+func (e *Extension) WriteResults(ctx context.Context, results []distributed.Result) error {
+	ctx, span := e.opts.Tracer.Start(ctx, "osquery.extension.WriteResults")
+	defer span.End()
+
+	nodeKey := e.currentNodeKey()
+	span.SetAttributes(
+		attribute.String("node_key_hash", hashNodeKey(nodeKey)),
+		attribute.Int("result_count", len(results)),
+	)
+
+	// Computing the approximate serialized size of every row is only
+	// worth its own full scan of the batch when MaxBytesPerQuery is
+	// actually enforced; with it unset (the default), skip the extra
+	// pass entirely rather than paying for a batch_bytes attribute
+	// nothing is capping against.
+	trackBytes := e.opts.MaxBytesPerQuery > 0
+	batchBytes := 0
+	sendable := make([]distributed.Result, len(results))
+	for i, r := range results {
+		_, resultSpan := e.opts.Tracer.Start(ctx, "osquery.extension.WriteResults.result")
+		resultSpan.SetAttributes(
+			attribute.String("query_name", r.QueryName),
+			attribute.Int("row_count", len(r.Rows)),
+		)
+
+		truncated, reason, originalRows, originalBytes := e.truncateResult(r)
+		if reason != "" {
+			e.reportTruncation(r.QueryName, reason, originalRows, originalBytes)
+			resultSpan.SetAttributes(attribute.String("truncated_reason", reason))
+		}
+		sendable[i] = truncated
+		if trackBytes {
+			batchBytes += approxRowsBytes(truncated.Rows)
+		}
+		resultSpan.End()
+	}
+	if trackBytes {
+		span.SetAttributes(attribute.Int("batch_bytes", batchBytes))
+	}
+
+	if _, invalid, err := e.client.PublishResults(ctx, nodeKey, sendable); err != nil {
+		span.RecordError(err)
+		return errors.Wrap(err, "publishing results")
+	} else if invalid {
+		err := errors.New("enrollment invalid publishing results")
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *Extension) truncateResult(r distributed.Result) (result distributed.Result, reason string, originalRows, originalBytes int) {
+	originalRows = len(r.Rows)
+
+	rows := r.Rows
+	if e.opts.MaxRowsPerQuery > 0 && len(rows) > e.opts.MaxRowsPerQuery {
+		rows = rows[:e.opts.MaxRowsPerQuery]
+		reason = "max_rows_per_query"
+	}
+	if e.opts.MaxBytesPerQuery > 0 {
+		// Only scan rows for their approximate serialized size when the
+		// byte cap is actually in effect -- this is the hot path for
+		// the runaway-query case the cap targets, and a full scan of
+		// every row is wasted work when MaxBytesPerQuery is the
+		// default, unset back-compat value.
+		originalBytes = approxRowsBytes(r.Rows)
+		if capped := truncateToByteLimit(rows, e.opts.MaxBytesPerQuery); len(capped) < len(rows) {
+			rows = capped
+			reason = "max_bytes_per_query"
+		}
+	}
+
+	if reason == "" {
+		return r, "", 0, 0
+	}
+
+	r.Rows = rows
+	return r, reason, originalRows, originalBytes
+}
+
+// LogString publishes a log line to the Kolide server. It satisfies
+// pkg/osquery/logger.Backend and is the "grpc" destination the
+// "kolide_grpc" logger plugin's Multiplexer fans out to. MaxBytesPerQuery bounds
+// query result sets, which WriteResults truncates row by row; a log
+// line is a single atomic JSON document, so truncating it at a byte
+// offset would ship a corrupt prefix to the server instead.
+// An oversized line is dropped whole rather than truncated.
+func (e *Extension) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	ctx, span := e.opts.Tracer.Start(ctx, "osquery.extension.LogString")
+	defer span.End()
+
+	queryName := logQueryName(logText)
+	span.SetAttributes(
+		attribute.String("query_name", queryName),
+		attribute.String("log_type", fmt.Sprintf("%v", typ)),
+	)
+
+	if e.opts.MaxBytesPerQuery > 0 && int64(len(logText)) > e.opts.MaxBytesPerQuery {
+		e.reportTruncation(queryName, "dropped_oversized_log", 1, len(logText))
+		span.SetAttributes(attribute.String("truncated_reason", "dropped_oversized_log"))
+		return nil
+	}
+	span.SetAttributes(attribute.Int("batch_bytes", len(logText)))
+
+	nodeKey := e.currentNodeKey()
+	if _, invalid, err := e.client.PublishLogs(ctx, nodeKey, typ, []string{logText}); err != nil {
+		span.RecordError(err)
+		return errors.Wrap(err, "publishing logs")
+	} else if invalid {
+		err := errors.New("enrollment invalid publishing logs")
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+// queryStat is the record persisted per query name in queryStatsBucket
+// and surfaced by the kolide_launcher_query_stats table.
+type queryStat struct {
+	QueryName         string    `json:"query_name"`
+	TruncatedCount    int       `json:"truncated_count"`
+	LastReason        string    `json:"last_reason"`
+	LastOriginalRows  int       `json:"last_original_rows"`
+	LastOriginalBytes int       `json:"last_original_bytes"`
+	LastTruncatedAt   time.Time `json:"last_truncated_at"`
+}
+
+// reportTruncation logs the oversized result/log at info level and
+// updates the running counter for queryName in queryStatsBucket.
+func (e *Extension) reportTruncation(queryName, reason string, originalRows, originalBytes int) {
+	level.Info(e.logger).Log(
+		"msg", "oversized query result or log",
+		"query_name", queryName,
+		"reason", reason,
+		"original_rows", originalRows,
+		"original_bytes", originalBytes,
+	)
+
+	if e.db == nil {
+		return
+	}
+
+	if err := e.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(queryStatsBucket))
+		if b == nil {
+			return nil
+		}
+
+		stat := queryStat{QueryName: queryName}
+		if raw := b.Get([]byte(queryName)); raw != nil {
+			_ = json.Unmarshal(raw, &stat)
+		}
+		stat.TruncatedCount++
+		stat.LastReason = reason
+		stat.LastOriginalRows = originalRows
+		stat.LastOriginalBytes = originalBytes
+		stat.LastTruncatedAt = time.Now()
+
+		raw, err := json.Marshal(stat)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(queryName), raw)
+	}); err != nil {
+		level.Debug(e.logger).Log("msg", "recording query truncation stat", "err", err)
+	}
+}
+
+func approxRowsBytes(rows []map[string]string) int {
+	total := 0
+	for _, row := range rows {
+		for k, v := range row {
+			total += len(k) + len(v)
+		}
+	}
+	return total
+}
+
+// truncateToByteLimit drops rows from the end of rows until the
+// approximate serialized size is at or under limit.
+func truncateToByteLimit(rows []map[string]string, limit int64) []map[string]string {
+	total := int64(0)
+	for i, row := range rows {
+		rowBytes := int64(0)
+		for k, v := range row {
+			rowBytes += int64(len(k) + len(v))
+		}
+		if total+rowBytes > limit {
+			return rows[:i]
+		}
+		total += rowBytes
+	}
+	return rows
+}
+
+// applyEntriesLimit appends "LIMIT <n>" to query if it doesn't already
+// contain a LIMIT clause. This is a best-effort guard, not a SQL
+// rewrite -- queries that already bound their own result set are left
+// untouched.
+func applyEntriesLimit(query string, n int) string {
+	if containsLimitClause(query) {
+		return query
+	}
+	return fmt.Sprintf("%s LIMIT %d", trimTrailingSemicolon(query), n)
+}
+
+// limitClausePattern matches "limit" as a whole word, so a column or
+// identifier named e.g. "rate_limit" doesn't get mistaken for an
+// existing LIMIT clause. It's still a text match, not a SQL parse, so
+// "limit" inside a string literal or a subquery's own LIMIT will still
+// read as bounded -- applyEntriesLimit is a best-effort guard, not a
+// SQL rewrite.
+var limitClausePattern = regexp.MustCompile(`(?i)\blimit\b`)
+
+func containsLimitClause(query string) bool {
+	return limitClausePattern.MatchString(query)
+}
+
+func trimTrailingSemicolon(query string) string {
+	for len(query) > 0 && (query[len(query)-1] == ';' || query[len(query)-1] == ' ') {
+		query = query[:len(query)-1]
+	}
+	return query
+}
+
+// logQueryName best-effort extracts the "name" field osquery's own
+// result/status/snapshot log JSON carries, falling back to "unknown"
+// for lines that aren't the shape we expect.
+func logQueryName(logText string) string {
+	var parsed struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(logText), &parsed); err != nil || parsed.Name == "" {
+		return "unknown"
+	}
+	return parsed.Name
+}
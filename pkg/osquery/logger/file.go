@@ -0,0 +1,114 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+)
+
+// maxLogFileBytes is the size at which a log file is rotated before
+// the next write. It intentionally mirrors the rough order of
+// magnitude osquery's own filesystem logger plugin uses.
+const maxLogFileBytes = 25 << 20 // 25MB
+
+// maxLogFileGenerations is how many rotated generations (path+".1"
+// through path+".<N>") are kept alongside the active file. The oldest
+// generation is discarded once this many have accumulated.
+const maxLogFileGenerations = 5
+
+// FileBackend appends every log line, regardless of type, to a single
+// rotating file. It's the simple option for operators who just want
+// launcher's logs on disk somewhere.
+type FileBackend struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileBackend returns a FileBackend writing to <dir>/launcher-osquery.log.
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating log directory: %w", err)
+	}
+	return &FileBackend{path: filepath.Join(dir, "launcher-osquery.log")}, nil
+}
+
+func (f *FileBackend) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return appendRotating(f.path, []byte(logText+"\n"))
+}
+
+// FilesystemBackend mirrors osquery's own filesystem logger plugin
+// layout: one rotating file per log type (results, snapshots,
+// status), all under a single directory.
+type FilesystemBackend struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFilesystemBackend returns a FilesystemBackend writing under dir.
+func NewFilesystemBackend(dir string) (*FilesystemBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating log directory: %w", err)
+	}
+	return &FilesystemBackend{dir: dir}, nil
+}
+
+func (f *FilesystemBackend) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := filepath.Join(f.dir, fmt.Sprintf("osqueryd.%s.log", typeName(typ)))
+	return appendRotating(path, []byte(logText+"\n"))
+}
+
+// appendRotating appends data to path, rotating path through up to
+// maxLogFileGenerations numbered backups first if appending would
+// push it over maxLogFileBytes. Generations shift up by one (".1"
+// becomes ".2", and so on); the oldest generation is discarded rather
+// than overwritten in place, so a rotation never silently destroys the
+// previous generation's contents.
+func appendRotating(path string, data []byte) error {
+	if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(data)) > maxLogFileBytes {
+		if err := rotateGenerations(path); err != nil {
+			return fmt.Errorf("rotating %s: %w", path, err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	return err
+}
+
+// rotateGenerations shifts path.(N-1) -> path.N down to path.1,
+// discarding path.<maxLogFileGenerations> if present, then moves path
+// itself to path.1.
+func rotateGenerations(path string) error {
+	oldest := fmt.Sprintf("%s.%d", path, maxLogFileGenerations)
+	if _, err := os.Stat(oldest); err == nil {
+		if err := os.Remove(oldest); err != nil {
+			return err
+		}
+	}
+
+	for gen := maxLogFileGenerations - 1; gen >= 1; gen-- {
+		from := fmt.Sprintf("%s.%d", path, gen)
+		to := fmt.Sprintf("%s.%d", path, gen+1)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(path, path+".1")
+}
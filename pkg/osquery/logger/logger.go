@@ -0,0 +1,90 @@
+// Package logger implements a small pluggable registry of osquery
+// logger backends.
+//
+// createExtensionRuntime used to hard-wire the osquery logger plugin
+// to the Kolide gRPC extension, so every result/status/snapshot line
+// had to leave the host over gRPC. This package lets that plugin fan
+// out to any combination of backends -- the Kolide server, a local
+// file, stdout, syslog, or osquery's own per-type filesystem layout --
+// selected at runtime via --log_destinations.
+package logger
+
+import (
+	"context"
+	"fmt"
+
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+)
+
+// Backend is implemented by anything that can receive an osquery
+// result/status/snapshot log line.
+type Backend interface {
+	LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error
+}
+
+// Multiplexer fans a single LogString call out to every configured
+// Backend so the osquery logger plugin can write to more than one
+// destination at a time.
+type Multiplexer struct {
+	backends []Backend
+}
+
+// NewMultiplexer returns a Multiplexer that writes every log line to
+// each of backends, in order.
+func NewMultiplexer(backends ...Backend) *Multiplexer {
+	return &Multiplexer{backends: backends}
+}
+
+// LogString implements Backend. Every backend is given a chance to
+// write even if an earlier one errors; the first error seen is
+// returned to the caller.
+func (m *Multiplexer) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	var firstErr error
+	for _, b := range m.backends {
+		if err := b.LogString(ctx, typ, logText); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Resolve turns the comma-separated --log_destinations value into the
+// list of Backends createExtensionRuntime should register. grpc maps
+// to ext, which is expected to already implement Backend (it does,
+// via osquery.Extension.LogString).
+func Resolve(destinations []string, ext Backend, dir string) ([]Backend, error) {
+	if len(destinations) == 0 {
+		destinations = []string{"grpc"}
+	}
+
+	backends := make([]Backend, 0, len(destinations))
+	for _, d := range destinations {
+		switch d {
+		case "grpc":
+			backends = append(backends, ext)
+		case "stdout":
+			backends = append(backends, NewStdoutBackend())
+		case "file":
+			b, err := NewFileBackend(dir)
+			if err != nil {
+				return nil, fmt.Errorf("creating file logger backend: %w", err)
+			}
+			backends = append(backends, b)
+		case "filesystem":
+			b, err := NewFilesystemBackend(dir)
+			if err != nil {
+				return nil, fmt.Errorf("creating filesystem logger backend: %w", err)
+			}
+			backends = append(backends, b)
+		case "syslog":
+			b, err := NewSyslogBackend()
+			if err != nil {
+				return nil, fmt.Errorf("creating syslog logger backend: %w", err)
+			}
+			backends = append(backends, b)
+		default:
+			return nil, fmt.Errorf("unknown log destination %q", d)
+		}
+	}
+	return backends, nil
+}
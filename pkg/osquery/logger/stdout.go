@@ -0,0 +1,37 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+)
+
+// StdoutBackend writes every log line to stdout, prefixed with its
+// osquery log type. Useful for local debugging and for container
+// deployments that ship stdout to their own log collector.
+type StdoutBackend struct{}
+
+// NewStdoutBackend returns a Backend that writes to os.Stdout.
+func NewStdoutBackend() *StdoutBackend {
+	return &StdoutBackend{}
+}
+
+func (s *StdoutBackend) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	_, err := fmt.Fprintf(os.Stdout, "%s: %s\n", typeName(typ), logText)
+	return err
+}
+
+func typeName(typ osquerylogger.LogType) string {
+	switch typ {
+	case osquerylogger.LogTypeStatus:
+		return "status"
+	case osquerylogger.LogTypeSnapshot:
+		return "snapshot"
+	case osquerylogger.LogTypeInit:
+		return "init"
+	default:
+		return "result"
+	}
+}
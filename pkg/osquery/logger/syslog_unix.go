@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package logger
+
+import (
+	"context"
+	"log/syslog"
+
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+)
+
+// SyslogBackend writes log lines to the local syslog daemon over the
+// platform's native transport.
+type SyslogBackend struct {
+	w *syslog.Writer
+}
+
+// NewSyslogBackend dials the local syslog daemon.
+func NewSyslogBackend() (*SyslogBackend, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "launcher")
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogBackend{w: w}, nil
+}
+
+func (s *SyslogBackend) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	if typ == osquerylogger.LogTypeStatus {
+		return s.w.Warning(logText)
+	}
+	return s.w.Info(logText)
+}
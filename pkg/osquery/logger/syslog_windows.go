@@ -0,0 +1,40 @@
+//go:build windows
+// +build windows
+
+package logger
+
+import (
+	"context"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+)
+
+// SyslogBackend writes log lines to the Windows Event Log, the
+// platform-native equivalent of syslog.
+type SyslogBackend struct {
+	log *eventlog.Log
+}
+
+// NewSyslogBackend opens (or installs, if missing) the "launcher"
+// event source and returns a Backend writing to it.
+func NewSyslogBackend() (*SyslogBackend, error) {
+	const source = "launcher"
+	if err := eventlog.InstallAsEventCreate(source, eventlog.Info|eventlog.Warning|eventlog.Error); err != nil {
+		// Typically already installed; fall through and try to open it.
+		_ = err
+	}
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogBackend{log: l}, nil
+}
+
+func (s *SyslogBackend) LogString(ctx context.Context, typ osquerylogger.LogType, logText string) error {
+	if typ == osquerylogger.LogTypeStatus {
+		return s.log.Warning(1, logText)
+	}
+	return s.log.Info(1, logText)
+}
@@ -0,0 +1,335 @@
+// Package runtime manages the osqueryd process launcher spawns and
+// owns: building its flags, serving launcher's extension plugins over
+// its thrift socket, and restarting it when it dies or is told to.
+// cmd/launcher/extension_socket.go's socketRunner is the sidecar
+// counterpart for when some other process manager already owns
+// osqueryd.
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kolide/launcher/pkg/backoff"
+	osquerygo "github.com/kolide/osquery-go"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instanceOpts collects everything LaunchUnstartedInstance's
+// functional options configure. There's no default construction of
+// OsqueryInstance outside of LaunchUnstartedInstance, so every field
+// here has a corresponding With* option.
+type instanceOpts struct {
+	binaryPath        string
+	rootDirectory     string
+	configPlugin      string
+	loggerPlugin      string
+	distributedPlugin string
+	extensionPlugins  []osquerygo.OsqueryPlugin
+	stdout            io.Writer
+	stderr            io.Writer
+	logger            log.Logger
+	verbose           bool
+	flags             []string
+	lensFunc          func(string) (string, error)
+	connectRetry      backoff.Options
+	tracer            trace.Tracer
+
+	configRefreshSeconds            int
+	configAcceleratedRefreshSeconds int
+}
+
+// Option configures an OsqueryInstance before it's started.
+type Option func(*instanceOpts)
+
+func WithOsquerydBinary(path string) Option {
+	return func(o *instanceOpts) { o.binaryPath = path }
+}
+
+func WithRootDirectory(dir string) Option {
+	return func(o *instanceOpts) { o.rootDirectory = dir }
+}
+
+func WithConfigPluginFlag(name string) Option {
+	return func(o *instanceOpts) { o.configPlugin = name }
+}
+
+func WithLoggerPluginFlag(name string) Option {
+	return func(o *instanceOpts) { o.loggerPlugin = name }
+}
+
+func WithDistributedPluginFlag(name string) Option {
+	return func(o *instanceOpts) { o.distributedPlugin = name }
+}
+
+func WithOsqueryExtensionPlugins(plugins ...osquerygo.OsqueryPlugin) Option {
+	return func(o *instanceOpts) { o.extensionPlugins = plugins }
+}
+
+func WithStdout(w io.Writer) Option {
+	return func(o *instanceOpts) { o.stdout = w }
+}
+
+func WithStderr(w io.Writer) Option {
+	return func(o *instanceOpts) { o.stderr = w }
+}
+
+func WithLogger(logger log.Logger) Option {
+	return func(o *instanceOpts) { o.logger = logger }
+}
+
+func WithOsqueryVerbose(verbose bool) Option {
+	return func(o *instanceOpts) { o.verbose = verbose }
+}
+
+func WithOsqueryFlags(flags []string) Option {
+	return func(o *instanceOpts) { o.flags = flags }
+}
+
+// WithAugeasLensFunction installs augeas lenses into a temp directory
+// before osqueryd starts (needed for the augeas table) and points
+// osqueryd at the returned directory via --augeas_lenses.
+func WithAugeasLensFunction(fn func(rootDirectory string) (lensDirectory string, err error)) Option {
+	return func(o *instanceOpts) { o.lensFunc = fn }
+}
+
+// WithConnectRetry bounds the retry loop Start uses to dial the
+// freshly-spawned osqueryd's extension socket, which may not exist
+// for a moment after the process starts.
+func WithConnectRetry(opts backoff.Options) Option {
+	return func(o *instanceOpts) { o.connectRetry = opts }
+}
+
+// WithTracer sets the tracer Start uses to emit a span around the
+// extension socket dial.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(o *instanceOpts) { o.tracer = tracer }
+}
+
+// WithConfigRefresh sets osqueryd's --config_refresh and
+// --config_accelerated_refresh flags, in seconds. Zero leaves the
+// corresponding flag unset, so osqueryd falls back to its own default.
+func WithConfigRefresh(refreshSeconds, acceleratedRefreshSeconds int) Option {
+	return func(o *instanceOpts) {
+		o.configRefreshSeconds = refreshSeconds
+		o.configAcceleratedRefreshSeconds = acceleratedRefreshSeconds
+	}
+}
+
+// OsqueryInstance manages a single osqueryd process that launcher
+// spawned: starting it with the right flags, serving the extension
+// plugins over its thrift socket, and restarting it on demand.
+type OsqueryInstance struct {
+	opts instanceOpts
+
+	// mu guards every field below AND is held for the full duration of
+	// each client call, for the same reason as socketRunner's mu: the
+	// thrift client isn't safe for concurrent use, and Query (driven by
+	// ext.SetQuerier) can run at any time relative to Start/Shutdown.
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	server *osquerygo.ExtensionManagerServer
+	client *osquerygo.ExtensionManagerClient
+}
+
+// LaunchUnstartedInstance builds an OsqueryInstance from opts without
+// starting osqueryd; callers start it explicitly via Start so they can
+// control retry/backoff around the first launch.
+func LaunchUnstartedInstance(opts ...Option) *OsqueryInstance {
+	var o instanceOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.logger == nil {
+		o.logger = log.NewNopLogger()
+	}
+	return &OsqueryInstance{opts: o}
+}
+
+func (i *OsqueryInstance) socketPath() string {
+	return filepath.Join(i.opts.rootDirectory, "osquery.sock")
+}
+
+// Start spawns osqueryd with the configured flags and dials its
+// extension socket, registering the extension plugins against it. The
+// socket dial is retried per opts.connectRetry since osqueryd creates
+// it a moment after the process starts; a failure to spawn the process
+// itself is not retried here -- callers retry the whole Start call.
+func (i *OsqueryInstance) Start() error {
+	rootDir := i.opts.rootDirectory
+	if rootDir != "" {
+		if err := os.MkdirAll(rootDir, 0755); err != nil {
+			return errors.Wrapf(err, "creating root directory %s", rootDir)
+		}
+	}
+
+	lensDir := rootDir
+	if i.opts.lensFunc != nil {
+		dir, err := i.opts.lensFunc(rootDir)
+		if err != nil {
+			return errors.Wrap(err, "installing augeas lenses")
+		}
+		lensDir = dir
+	}
+
+	socketPath := i.socketPath()
+	args := []string{
+		"--extensions_socket=" + socketPath,
+		"--extensions_autoload=",
+		"--config_plugin=" + i.opts.configPlugin,
+		"--logger_plugin=" + i.opts.loggerPlugin,
+		"--distributed_plugin=" + i.opts.distributedPlugin,
+		"--distributed_interval=5",
+		"--disable_distributed=false",
+		"--pidfile=" + filepath.Join(rootDir, "osquery.pid"),
+		"--database_path=" + filepath.Join(rootDir, "osquery.db"),
+	}
+	if rootDir != "" {
+		args = append(args, "--extensions_interval=3")
+	}
+	if lensDir != "" {
+		args = append(args, "--augeas_lenses="+lensDir)
+	}
+	if i.opts.verbose {
+		args = append(args, "--verbose")
+	}
+	if i.opts.configRefreshSeconds > 0 {
+		args = append(args, "--config_refresh="+strconv.Itoa(i.opts.configRefreshSeconds))
+	}
+	if i.opts.configAcceleratedRefreshSeconds > 0 {
+		args = append(args, "--config_accelerated_refresh="+strconv.Itoa(i.opts.configAcceleratedRefreshSeconds))
+	}
+	args = append(args, i.opts.flags...)
+
+	cmd := exec.Command(i.opts.binaryPath, args...)
+	cmd.Stdout = i.opts.stdout
+	cmd.Stderr = i.opts.stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = ioutil.Discard
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = ioutil.Discard
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "starting osqueryd")
+	}
+
+	ctx := context.Background()
+	if i.opts.tracer != nil {
+		var span trace.Span
+		ctx, span = i.opts.tracer.Start(ctx, "runtime.dialExtensionSocket")
+		defer span.End()
+	}
+
+	client, server, err := dialExtensionSocket(ctx, i.opts.logger, i.opts.connectRetry, socketPath, i.opts.extensionPlugins)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return errors.Wrap(err, "registering extension plugins against osqueryd")
+	}
+
+	i.mu.Lock()
+	i.cmd = cmd
+	i.client = client
+	i.server = server
+	i.mu.Unlock()
+
+	return nil
+}
+
+// dialExtensionSocket retries dialing socketPath until osqueryd has
+// created it, then starts an extension manager server there with
+// plugins registered.
+func dialExtensionSocket(ctx context.Context, logger log.Logger, retryOpts backoff.Options, socketPath string, plugins []osquerygo.OsqueryPlugin) (*osquerygo.ExtensionManagerClient, *osquerygo.ExtensionManagerServer, error) {
+	var client *osquerygo.ExtensionManagerClient
+	var server *osquerygo.ExtensionManagerServer
+
+	err := backoff.Retry(ctx, logger, retryOpts, func() error {
+		c, err := osquerygo.NewClient(socketPath, 5*time.Second)
+		if err != nil {
+			return err
+		}
+
+		s, err := osquerygo.NewExtensionManagerServer("kolide", socketPath)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		for _, p := range plugins {
+			s.RegisterPlugin(p)
+		}
+		if err := s.Start(); err != nil {
+			c.Close()
+			return err
+		}
+
+		client, server = c, s
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// Restart shuts down the current osqueryd process (if any) and starts
+// a fresh one.
+func (i *OsqueryInstance) Restart() error {
+	if err := i.Shutdown(); err != nil {
+		level.Debug(i.opts.logger).Log("msg", "error shutting down osquery instance before restart", "err", err)
+	}
+	return i.Start()
+}
+
+// Shutdown de-registers the extension plugins, closes the thrift
+// client, and stops the osqueryd process launcher spawned.
+func (i *OsqueryInstance) Shutdown() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var err error
+	if i.server != nil {
+		err = i.server.Shutdown()
+		i.server = nil
+	}
+	if i.client != nil {
+		i.client.Close()
+		i.client = nil
+	}
+	if i.cmd != nil && i.cmd.Process != nil {
+		if killErr := i.cmd.Process.Kill(); killErr != nil && err == nil {
+			err = killErr
+		}
+		_ = i.cmd.Wait()
+		i.cmd = nil
+	}
+	return err
+}
+
+// Query implements osquery.Querier against the osqueryd instance this
+// runtime owns.
+func (i *OsqueryInstance) Query(sql string) ([]map[string]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.client == nil {
+		return nil, errors.New("osquery instance is not started")
+	}
+
+	resp, err := i.client.Query(sql)
+	if err != nil {
+		return nil, fmt.Errorf("querying osqueryd: %w", err)
+	}
+	return resp.Response, nil
+}
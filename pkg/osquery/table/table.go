@@ -0,0 +1,85 @@
+// Package table implements the osquery tables launcher exposes on top
+// of whatever osqueryd instance it's managing.
+package table
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/kolide/launcher/pkg/launcher"
+	osquerygo "github.com/kolide/osquery-go"
+	"github.com/kolide/osquery-go/plugin/table"
+	"go.etcd.io/bbolt"
+)
+
+// queryStatsBucket mirrors pkg/osquery's bucket of the same name,
+// where Extension records per-query truncation counters.
+const queryStatsBucket = "query_stats"
+
+// LauncherTables returns the osquery tables launcher registers
+// alongside the gRPC config/distributed/logger plugins.
+func LauncherTables(db *bbolt.DB, opts *launcher.Options) []osquerygo.OsqueryPlugin {
+	return []osquerygo.OsqueryPlugin{
+		queryStatsTable(db),
+	}
+}
+
+// queryStatsTable exposes kolide_launcher_query_stats, one row per
+// query name that's ever been truncated by the per-query row/byte
+// caps in pkg/osquery.ExtensionOpts.
+func queryStatsTable(db *bbolt.DB) *table.Plugin {
+	columns := []table.ColumnDefinition{
+		table.TextColumn("query_name"),
+		table.IntegerColumn("truncated_count"),
+		table.TextColumn("last_reason"),
+		table.IntegerColumn("last_original_rows"),
+		table.IntegerColumn("last_original_bytes"),
+		table.TextColumn("last_truncated_at"),
+	}
+
+	generate := func(ctx context.Context, queryContext table.QueryContext) ([]map[string]string, error) {
+		if db == nil {
+			return nil, nil
+		}
+
+		var rows []map[string]string
+		err := db.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(queryStatsBucket))
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(_, v []byte) error {
+				var stat struct {
+					QueryName         string `json:"query_name"`
+					TruncatedCount    int    `json:"truncated_count"`
+					LastReason        string `json:"last_reason"`
+					LastOriginalRows  int    `json:"last_original_rows"`
+					LastOriginalBytes int    `json:"last_original_bytes"`
+					LastTruncatedAt   string `json:"last_truncated_at"`
+				}
+				// A row we can't parse is skipped rather than
+				// failing the whole table -- one corrupt record
+				// shouldn't hide every other query's stats.
+				if err := json.Unmarshal(v, &stat); err != nil {
+					return nil
+				}
+				rows = append(rows, map[string]string{
+					"query_name":          stat.QueryName,
+					"truncated_count":     strconv.Itoa(stat.TruncatedCount),
+					"last_reason":         stat.LastReason,
+					"last_original_rows":  strconv.Itoa(stat.LastOriginalRows),
+					"last_original_bytes": strconv.Itoa(stat.LastOriginalBytes),
+					"last_truncated_at":   stat.LastTruncatedAt,
+				})
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	return table.NewPlugin("kolide_launcher_query_stats", columns, generate)
+}
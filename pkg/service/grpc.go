@@ -0,0 +1,32 @@
+package service
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+)
+
+// GRPCDialOptions returns the dial options the concrete gRPC-backed
+// KolideService client should always use: otelgrpc's client
+// interceptors, so every RequestEnrollment/RequestConfig/
+// RequestQueries/PublishResults/PublishLogs call becomes a child span
+// of whatever span is active on the call's context (GenerateConfigs,
+// GetQueries, WriteResults, LogString in pkg/osquery), and appends any
+// caller-supplied options after them so callers can still override
+// transport credentials, keepalive, etc.
+func GRPCDialOptions(opts ...grpc.DialOption) []grpc.DialOption {
+	return append([]grpc.DialOption{
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	}, opts...)
+}
+
+// Dial opens the gRPC connection a KolideService client is built on
+// top of. It's the one dial path the concrete client is expected to
+// use, so GRPCDialOptions' otelgrpc interceptors are always applied
+// here rather than left for each call site to remember to add --
+// without them, RPCs made from GenerateConfigs/GetQueries/
+// WriteResults/LogString would carry no trace context for the server
+// to link its own spans back to.
+func Dial(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	return grpc.Dial(target, GRPCDialOptions(opts...)...)
+}
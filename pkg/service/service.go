@@ -0,0 +1,38 @@
+// Package service defines launcher's client-side view of the Kolide
+// gRPC server: enrollment, config, distributed queries, and log
+// publishing. Concrete transports (gRPC today) implement KolideService
+// against the generated protobuf client.
+package service
+
+import (
+	"context"
+
+	"github.com/kolide/osquery-go/plugin/distributed"
+	osquerylogger "github.com/kolide/osquery-go/plugin/logger"
+)
+
+// EnrollmentDetails carries the host metadata sent along with an
+// enrollment request (platform, osquery version, hardware identifiers,
+// etc). It's a separate type from the request call itself so new
+// fields can be added without changing the KolideService signature.
+type EnrollmentDetails struct {
+	OSVersion      string
+	OSPlatform     string
+	OsqueryVersion string
+	Hostname       string
+	HardwareSerial string
+	HardwareUUID   string
+}
+
+// KolideService is launcher's RPC surface against the Kolide server.
+// Every method follows the same (result, invalid, err) shape: invalid
+// means the server rejected the node's credentials (a bad enroll
+// secret or a revoked node key) and is terminal, distinct from a
+// transient transport error in err.
+type KolideService interface {
+	RequestEnrollment(ctx context.Context, enrollSecret, hostIdentifier string, details EnrollmentDetails) (nodeKey string, invalid bool, err error)
+	RequestConfig(ctx context.Context, nodeKey string) (config string, invalid bool, err error)
+	RequestQueries(ctx context.Context, nodeKey string) (queries *distributed.GetQueriesResult, invalid bool, err error)
+	PublishResults(ctx context.Context, nodeKey string, results []distributed.Result) (message string, invalid bool, err error)
+	PublishLogs(ctx context.Context, nodeKey string, logType osquerylogger.LogType, logs []string) (message string, invalid bool, err error)
+}
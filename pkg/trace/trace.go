@@ -0,0 +1,72 @@
+// Package trace wires up the OpenTelemetry tracer provider launcher
+// uses to emit spans for the osquery extension lifecycle (startup,
+// enrollment, distributed query execution) so those phases show up in
+// Jaeger/Tempo instead of only in debug logs.
+package trace
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer builds a trace.Tracer backed by the exporter named by
+// exporterKind ("otlp", "stdout", or "none"), and returns a shutdown
+// func that flushes and closes it. Callers that pass "none" get
+// otel.Tracer's no-op implementation and a no-op shutdown func, so
+// call sites never need to special-case tracing being disabled.
+func NewTracer(ctx context.Context, exporterKind, endpoint string, samplingRatio float64) (trace.Tracer, func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	switch exporterKind {
+	case "", "none":
+		return otel.Tracer("launcher"), noop, nil
+
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating stdout trace exporter: %w", err)
+		}
+		return newProvider(exp, samplingRatio)
+
+	case "otlp":
+		client := otlptracegrpc.NewClient(otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+		exp, err := otlptrace.New(ctx, client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating otlp trace exporter: %w", err)
+		}
+		return newProvider(exp, samplingRatio)
+
+	default:
+		return nil, nil, fmt.Errorf("unknown trace_exporter %q", exporterKind)
+	}
+}
+
+func newProvider(exp sdktrace.SpanExporter, samplingRatio float64) (trace.Tracer, func(context.Context) error, error) {
+	if samplingRatio <= 0 {
+		samplingRatio = 1
+	}
+
+	res, err := resource.New(context.Background(), resource.WithAttributes(
+		semconv.ServiceNameKey.String("launcher"),
+	))
+	if err != nil {
+		return nil, nil, fmt.Errorf("building trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(samplingRatio)),
+	)
+
+	return tp.Tracer("launcher"), tp.Shutdown, nil
+}